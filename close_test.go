@@ -0,0 +1,46 @@
+package extractor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestCloseStopsProducerGoroutine asserts that Close, called before the
+// background goroutine started by Next/NextWithError has delivered every
+// entry, still lets that goroutine exit rather than leaking it blocked on
+// e.c.
+func TestCloseStopsProducerGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(bytes.Repeat([]byte("x"), 1<<20))
+	gw.Close()
+
+	e := New(bytes.NewReader(buf.Bytes()), "bomb.gz")
+	r, _, more := e.Next(context.Background())
+	if !more {
+		t.Fatal("expected an entry")
+	}
+	// abandon the entry well before EOF, then Close instead of draining it.
+	if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leak: have %d, started with %d", runtime.NumGoroutine(), before)
+		}
+		runtime.Gosched()
+		time.Sleep(time.Millisecond)
+	}
+}
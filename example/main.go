@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -8,12 +9,13 @@ import (
 )
 
 func main() {
+	ctx := context.Background()
 	for _, file := range []string{"x2.tar", "x.bz2", "x.gz", "x.lz4", "x.rar", "x.tar", "x.txt", "x.xz", "x.zip"} {
 		fmt.Println("__", file, "__")
 		f, _ := os.Open(file)
 		e := extractor.New(f, file)
 		for {
-			r, fname, err, more := e.NextWithError()
+			r, fname, err, more := e.NextWithError(ctx)
 			if !more {
 				break
 			}
@@ -27,7 +29,9 @@ func main() {
 			// if err != nil {
 			// 	fmt.Println("reader == nil?:", r == nil)
 			// }
+			r.Close()
 		}
+		e.Close()
 		fmt.Println("-----------------")
 	}
 	// time.Sleep(time.Second * 20)
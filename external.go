@@ -0,0 +1,197 @@
+package extractor
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// externalToolArgs maps a whitelisted binary to the arguments that make it
+// extract src into dir non-interactively.
+var externalToolArgs = map[string]func(src, dir string) []string{
+	"tar":  func(src, dir string) []string { return []string{"-xf", src, "-C", dir} },
+	"7z":   func(src, dir string) []string { return []string{"x", "-y", "-o" + dir, src} },
+	"unar": func(src, dir string) []string { return []string{"-q", "-o", dir, src} },
+}
+
+// fallback attempts to extract f using one of the extractor's whitelisted
+// external tools, spooling br to a temp file first since these tools need
+// a seekable path rather than a stream. It reports whether f was handled:
+// either a tool successfully produced output, or ErrMaxSize was sent on e.c
+// because the size budget ran out. Any extracted files are streamed back
+// through e.c, recursively extracted just like a built-in format's entries.
+func (e *extractor) fallback(f *filestream, br *bufio.Reader) bool {
+	if len(e.externalTools) == 0 {
+		return false
+	}
+
+	src, err := e.spool(br)
+	if err != nil {
+		return false
+	}
+
+	for _, name := range e.externalTools {
+		args, ok := externalToolArgs[name]
+		if !ok {
+			continue
+		}
+
+		if e.maxTotalSize > 0 && atomic.LoadInt64(&e.totalRead) >= e.maxTotalSize {
+			// budget was already exhausted by earlier entries; don't even
+			// start unpacking this one onto disk.
+			e.send(&filestream{r: wrapCloser(strings.NewReader(""), nil), err: ErrMaxSize})
+			return true
+		}
+
+		// each tool gets its own fresh directory: a tool that partially
+		// extracts before exiting non-zero (common on sparse/unsupported
+		// archives, exactly what this fallback targets) must not leave
+		// that partial output for the next tool's walk to pick up.
+		dir, err := ioutil.TempDir("", "extractor-")
+		if err != nil {
+			continue
+		}
+		e.addTempFile(dir)
+
+		ok, exceeded := e.runExternalTool(name, args(src, dir), dir)
+		if exceeded {
+			// the tool was still unpacking when it wrote past the budget:
+			// report it as a bomb rather than silently trying the next
+			// tool, which would just repeat the same exhaustion.
+			e.send(&filestream{r: wrapCloser(strings.NewReader(""), nil), err: ErrMaxSize})
+			return true
+		}
+		if !ok {
+			continue
+		}
+
+		found := false
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if !underDir(dir, path) {
+				// guard against a crafted member path (e.g. "../etc/passwd")
+				// that made the tool write outside dir.
+				return nil
+			}
+			of, err := os.Open(path)
+			if err != nil {
+				return nil
+			}
+			found = true
+			rel, _ := filepath.Rel(dir, path)
+			e.extract(&filestream{r: of, filename: f.filename + e.sep + rel, depth: f.depth + 1})
+			return nil
+		})
+		if found {
+			return true
+		}
+	}
+	// spooling drained br; point it at the spooled copy so the caller can
+	// still hand out the original bytes.
+	if of, err := os.Open(src); err == nil {
+		br.Reset(of)
+	}
+	return false
+}
+
+// underDir reports whether path, resolved relative to dir, stays inside
+// dir rather than escaping it via a "../" component.
+func underDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// runExternalTool runs name with args, killing it after
+// e.externalToolTimeout if it hangs, or as soon as dir's total size crosses
+// what is left of e.maxTotalSize (after the bytes already read) if that's
+// set — otherwise MaxTotalSize (extractor.go) only
+// ever sees the bomb after the tool has already fully unpacked it to disk,
+// which just moves the exhaustion from RAM to disk. It reports whether the
+// command exited successfully, and separately whether it was killed for
+// crossing the size budget.
+func (e *extractor) runExternalTool(name string, args []string, dir string) (ok, exceeded bool) {
+	timeout := e.externalToolTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if e.maxTotalSize > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		var tripped int32
+		go watchDirSize(dir, e.maxTotalSize-atomic.LoadInt64(&e.totalRead), cancel, &tripped, done)
+		defer func() {
+			if atomic.LoadInt32(&tripped) != 0 {
+				exceeded = true
+			}
+		}()
+	}
+
+	return exec.CommandContext(ctx, name, args...).Run() == nil, exceeded
+}
+
+// watchDirSize polls dir every 100ms summing file sizes, and calls cancel
+// once the total crosses budget, setting *tripped so the caller can tell a
+// budget kill apart from a timeout or ordinary tool failure. It stops once
+// done is closed.
+func watchDirSize(dir string, budget int64, cancel context.CancelFunc, tripped *int32, done <-chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			var total int64
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					total += info.Size()
+				}
+				return nil
+			})
+			if total > budget {
+				atomic.StoreInt32(tripped, 1)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// spool copies r to a temp file and returns its path, since external tools
+// need a seekable path rather than a stream.
+func (e *extractor) spool(r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile("", "extractor-spool-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, r); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	e.addTempFile(tmp.Name())
+	return tmp.Name(), nil
+}
+
+// addTempFile records path so it can be removed once the extractor is
+// closed.
+func (e *extractor) addTempFile(path string) {
+	e.tempMu.Lock()
+	e.tempFiles = append(e.tempFiles, path)
+	e.tempMu.Unlock()
+}
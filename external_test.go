@@ -0,0 +1,24 @@
+package extractor
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUnderDirRejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(dir, "a", "b.txt"), true},
+		{filepath.Join(dir, "..", "etc", "passwd"), false},
+		{filepath.Dir(dir), false},
+	}
+	for _, c := range cases {
+		if got := underDir(dir, c.path); got != c.want {
+			t.Errorf("underDir(%q, %q) = %v, want %v", dir, c.path, got, c.want)
+		}
+	}
+}
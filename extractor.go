@@ -4,27 +4,31 @@
 package extractor
 
 import (
-	"archive/tar"
-	"archive/zip"
 	"bufio"
-	"compress/bzip2"
-	"compress/gzip"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
 
-	"github.com/nwaples/rardecode"
-	"github.com/pierrec/lz4"
-	"github.com/ulikunitz/xz"
+var (
+	NestError = errors.New("reader is nested archive that cannot be extracted.")
 
-	"github.com/aerissecure/mime"
-)
+	// ErrMaxDepth is returned when an archive is nested deeper than the
+	// configured MaxDepth option.
+	ErrMaxDepth = errors.New("extractor: maximum recursion depth exceeded")
 
-var NestError = errors.New("reader is nested archive that cannot be extracted.")
+	// ErrMaxSize is returned when decompressing an entry would exceed the
+	// configured MaxSize or MaxTotalSize option.
+	ErrMaxSize = errors.New("extractor: maximum decompressed size exceeded")
+
+	// ErrTimeout is returned when an extraction is aborted because its
+	// context deadline, or the Timeout option passed to New, has elapsed.
+	ErrTimeout = errors.New("extractor: extraction timed out")
+)
 
 type extractor struct {
 	r        io.Reader // underlying io.reader
@@ -32,202 +36,401 @@ type extractor struct {
 	filename string
 	once     sync.Once
 	sep      string // filename separator for nested files
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	maxDepth     int   // 0 means unlimited
+	maxSize      int64 // 0 means unlimited, per-entry decompressed size
+	maxTotalSize int64 // 0 means unlimited, across the whole extraction
+	totalRead    int64 // atomic, bytes yielded to the caller so far
+
+	disabled map[string]bool // format names excluded for this extractor
+	decoder  Decoder         // gzip/bzip2 implementation to use
+
+	externalTools       []string      // whitelisted binaries, tried in order
+	externalToolTimeout time.Duration // per-invocation timeout
+
+	tempMu    sync.Mutex
+	tempFiles []string // paths created while spooling for external tools
+
+	spoolToTemp bool // copy non-seekable input to disk for ZIP/7z support
+}
+
+// Option configures an extractor constructed with New.
+type Option func(*extractor)
+
+// MaxDepth bounds how many archives deep extract will recurse before
+// aborting with ErrMaxDepth. A value of 0 (the default) means unlimited.
+func MaxDepth(n int) Option {
+	return func(e *extractor) { e.maxDepth = n }
+}
+
+// MaxSize bounds the number of decompressed bytes that may be read from any
+// single yielded reader before it returns ErrMaxSize. A value of 0 (the
+// default) means unlimited.
+func MaxSize(n int64) Option {
+	return func(e *extractor) { e.maxSize = n }
+}
+
+// MaxTotalSize bounds the total number of decompressed bytes that may be
+// read across every reader yielded by the extractor before they start
+// returning ErrMaxSize. A value of 0 (the default) means unlimited.
+func MaxTotalSize(n int64) Option {
+	return func(e *extractor) { e.maxTotalSize = n }
 }
 
-// New configures and returns an extractor.
-func New(r io.Reader, filename string) *extractor {
+// Timeout bounds how long the overall extraction may run. Once it elapses,
+// in-flight and future reads abort with ErrTimeout. A value of 0 (the
+// default) means no deadline.
+func Timeout(d time.Duration) Option {
+	return func(e *extractor) {
+		if d > 0 {
+			e.ctx, e.cancel = context.WithTimeout(context.Background(), d)
+		}
+	}
+}
+
+// DisableFormats excludes the named formats (see Format.Name) from this
+// extractor, even if they're registered. Unknown names are ignored.
+func DisableFormats(names ...string) Option {
+	return func(e *extractor) {
+		for _, n := range names {
+			e.disabled[n] = true
+		}
+	}
+}
+
+// WithDecoder selects the gzip/bzip2 decoder implementation. The default,
+// the zero value DecoderStdlib, uses compress/gzip and compress/bzip2.
+func WithDecoder(d Decoder) Option {
+	return func(e *extractor) { e.decoder = d }
+}
+
+// ExternalTools whitelists external binaries (e.g. "tar", "7z", "unar")
+// that extract may shell out to when a built-in decoder fails to open an
+// archive, such as a RAR5 feature rardecode doesn't support, a sparse tar,
+// an encrypted zip, or an unrecognized format. Each is tried, in the order
+// given, against a spooled, seekable copy of the input. None are used
+// unless whitelisted here; the default is none.
+func ExternalTools(names ...string) Option {
+	return func(e *extractor) { e.externalTools = names }
+}
+
+// ExternalToolTimeout bounds how long a single external tool invocation
+// (see ExternalTools) may run before it is killed. The default is 30s.
+func ExternalToolTimeout(d time.Duration) Option {
+	return func(e *extractor) { e.externalToolTimeout = d }
+}
+
+// SpoolToTemp lets ZIP and 7z work from a plain, non-seekable io.Reader
+// input (e.g. an HTTP body, stdin, or a nested archive entry). Without it,
+// such formats need an *os.File or SizedReaderAt to get random access and
+// otherwise report NestError; with it, the stream is transparently copied
+// to a temp file and opened as one when needed. Off by default, since it
+// means buffering the full stream to disk.
+func SpoolToTemp() Option {
+	return func(e *extractor) { e.spoolToTemp = true }
+}
+
+// New configures and returns an extractor. Safety limits such as MaxDepth,
+// MaxSize, MaxTotalSize, and Timeout can be applied via opts, as can
+// DisableFormats.
+func New(r io.Reader, filename string, opts ...Option) *extractor {
 	c := make(chan *filestream)
-	return &extractor{
+	e := &extractor{
 		r:        r,
 		filename: filename,
 		c:        c,
 		sep:      ":",
+		ctx:      context.Background(),
+		disabled: map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
+	if e.cancel == nil {
+		e.ctx, e.cancel = context.WithCancel(e.ctx)
+	}
+	return e
 }
 
 type filestream struct {
 	r        io.Reader
 	filename string
 	err      error
+	depth    int // how many archives deep this filestream is nested
+}
+
+// limitedReader wraps an io.Reader and returns ErrMaxSize once either its
+// own byte budget or the extractor's total byte budget has been exhausted,
+// rather than silently truncating like io.LimitReader would. This is what
+// keeps a "zip bomb" from exhausting memory even if the caller reads to
+// EOF. It also checks the extractor's ctx on every Read and returns
+// ErrTimeout once it's done, so Timeout (or a linked Next/NextWithError
+// ctx) can abort a read already in progress on a yielded entry, not just
+// extraction between entries.
+type limitedReader struct {
+	r    io.Reader
+	e    *extractor
+	left int64 // remaining bytes allowed for this entry, -1 means unlimited
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if err := l.e.ctx.Err(); err != nil {
+		return 0, ErrTimeout
+	}
+	if l.left == 0 {
+		return 0, ErrMaxSize
+	}
+	if l.left > 0 && int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if l.left > 0 {
+			l.left -= int64(n)
+		}
+		if l.e.maxTotalSize > 0 && atomic.AddInt64(&l.e.totalRead, int64(n)) > l.e.maxTotalSize {
+			return n, ErrMaxSize
+		}
+	}
+	return n, err
+}
+
+// limit wraps r in a limitedReader, returning a *bufio.Reader ready to be
+// yielded to the caller. This always applies, even with MaxSize and
+// MaxTotalSize both unset, since limitedReader is also what makes Timeout
+// abort a read already in progress (see limitedReader.Read).
+func (e *extractor) limit(r io.Reader) *bufio.Reader {
+	left := int64(-1)
+	if e.maxSize > 0 {
+		left = e.maxSize
+	}
+	return bufio.NewReader(&limitedReader{r: r, e: e, left: left})
+}
+
+// readCloser pairs a reader with the real io.Closer that releases its
+// underlying resource (a gzip.Reader, a zip.File handle, a zstd decoder,
+// ...). r is almost always a *bufio.Reader wrapping several such layers by
+// the time it reaches the caller, so the closer has to be carried
+// alongside it explicitly rather than recovered from r itself.
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (rc readCloser) Close() error {
+	if rc.closer != nil {
+		return rc.closer.Close()
+	}
+	return nil
+}
+
+// wrapCloser adapts r into an io.ReadCloser whose Close releases closer.
+// If closer is nil but r already implements io.Closer, that is used
+// instead; otherwise Close is a no-op.
+func wrapCloser(r io.Reader, closer io.Closer) io.ReadCloser {
+	if closer == nil {
+		if rc, ok := r.(io.ReadCloser); ok {
+			return rc
+		}
+	}
+	return readCloser{Reader: r, closer: closer}
 }
 
 // extract recursively extracts bufio.Readers and writes them to extractor.c
 // channel using the io.Reader passed in with the first filestream.
 // Note, filestream uses io.Reader for flexibility in calling extract, but
-// all filestreams written to extractor.c channel are type bufio.Reader.
+// all filestreams written to extractor.c channel are type io.ReadCloser.
 func (e *extractor) extract(f *filestream) {
-	// ensure all branches guarantee a write to e.c, otherwise it will deadlock.
+	// ensure all branches guarantee a send (or abort) on e.c, otherwise it
+	// will deadlock.
 
 	br, ok := f.r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(f.r)
 	}
+	// f.r is the reader an Iterator handed us for this entry (e.g. the
+	// singleEntryReader a singleEntry wraps its decoder in, or a *zip.File's
+	// io.ReadCloser); it's the only place the real closer for this entry
+	// is still reachable, since br and e.limit(br) below are always fresh
+	// bufio.Readers that don't implement io.Closer themselves.
+	closer, _ := f.r.(io.Closer)
 
-	buf, _ := br.Peek(512)
-	mtype := mime.Detect(buf)
-
-	if mtype == mime.Gzip {
-		r, err := gzip.NewReader(br)
-		if err != nil {
-			f.err = err
-			f.r = br
-			e.c <- f
-			return
-		}
-
-		// is this close in the right spot, or do we need to pass require the caller to call close?
-		defer r.Close()
-		fname := f.filename + e.sep + r.Name
-		e.extract(&filestream{r: r, filename: fname})
+	if err := e.ctx.Err(); err != nil {
+		f.err = ErrTimeout
+		f.r = wrapCloser(br, closer)
+		e.send(f)
 		return
 	}
 
-	if mtype == mime.Bzip2 {
-		r := bzip2.NewReader(br)
-		// compression only, get name by removing file extension
-		fname := f.filename
-		split := strings.Split(f.filename, e.sep)
-		base := split[len(split)-1]
-		ext := filepath.Ext(base)
-		if ext == ".bz2" {
-			fname = f.filename + e.sep + base[:len(base)-len(ext)]
-		}
-		e.extract(&filestream{r: r, filename: fname})
+	if e.maxDepth > 0 && f.depth > e.maxDepth {
+		f.err = ErrMaxDepth
+		f.r = wrapCloser(br, closer)
+		e.send(f)
 		return
 	}
 
-	if mtype == mime.Zip {
-		// only process if is os.File. If caller wants the reader anyway, use
-		// NextWithError and check if err == NestError, along with the mime type.
+	buf, _ := br.Peek(512)
 
-		of, ok := f.r.(*os.File)
-		if !ok {
-			f.err = NestError
-			f.r = br
-			e.c <- f
-			return
+	for _, fm := range e.activeFormats() {
+		if !fm.Detect(buf) {
+			continue
 		}
-		fi, err := of.Stat()
-		if err != nil {
-			f.err = err
-			f.r = br
-			e.c <- f
-			return
+
+		in := io.Reader(br)
+		if _, ok := fm.(rawReader); ok {
+			// needs random access (io.ReaderAt) to the original reader,
+			// not the sequential, already-peeked one. The sizedReaderAt
+			// check is still against f.r (an *os.File's offset doesn't
+			// matter to io.ReaderAt), but spooling must read from br so
+			// the bytes already buffered by the Peek above aren't lost.
+			in = e.seekableInput(f.r, br)
 		}
-		r, err := zip.NewReader(of, fi.Size())
+
+		it, err := fm.Open(e.ctx, in)
 		if err != nil {
+			if e.fallback(f, br) {
+				return
+			}
 			f.err = err
-			f.r = br
-			e.c <- f
+			f.r = wrapCloser(br, closer)
+			e.send(f)
 			return
 		}
-		for _, file := range r.File {
-			zfr, err := file.Open()
-			if err != nil {
-				e.c <- &filestream{r: bufio.NewReader(zfr), err: err}
-				continue
-			}
-			fname := f.filename + e.sep + file.Name
-			e.extract(&filestream{r: zfr, filename: fname})
-		}
-		return
-	}
 
-	if mtype == mime.Tar {
-		r := tar.NewReader(br)
 		for {
-			hdr, err := r.Next()
+			name, r, err := it.Next()
 			if err == io.EOF { // include io.EOF
-				e.c <- &filestream{r: bufio.NewReader(r), err: err}
+				e.send(&filestream{r: wrapCloser(br, closer), err: err})
 				return
 			}
-			if hdr.Typeflag != tar.TypeReg {
-				// don't write to e.c
+			if err != nil {
+				// this entry failed to open, but the archive may still
+				// have more; report it and keep going.
+				entryCloser, _ := r.(io.Closer)
+				if !e.send(&filestream{r: wrapCloser(bufio.NewReader(r), entryCloser), err: err}) {
+					return
+				}
 				continue
 			}
-			fname := f.filename + e.sep + hdr.Name
-			e.extract(&filestream{r: r, filename: fname})
-		}
-		return // make sure to return a the end of each case
-	}
 
-	if mtype == mime.Rar {
-		r, err := rardecode.NewReader(br, "")
-		if err != nil {
-			f.err = err
-			f.r = br
-			e.c <- f
-			return
-		}
-		for {
-			hdr, err := r.Next()
-			if err != nil { // includes io.EOF
-				e.c <- &filestream{r: bufio.NewReader(r), err: err}
-				return
-			}
-			if hdr.IsDir {
-				// don't write to e.c
-				continue
+			fname := f.filename + e.sep + name
+			if name == "" {
+				fname = f.filename
+				if es, ok := fm.(extStripper); ok {
+					fname = stripExt(f.filename, e.sep, es.Ext())
+				}
 			}
-			fmt.Println("name:", hdr.Name)
-			fname := f.filename + e.sep + hdr.Name
-			e.extract(&filestream{r: r, filename: fname})
+			e.extract(&filestream{r: r, filename: fname, depth: f.depth + 1})
 		}
-		return // make sure to return a the end of each case
 	}
 
-	if mtype == mime.Xz {
-		r, err := xz.NewReader(br)
-		if err != nil {
-			f.err = err
-			f.r = br
-			e.c <- f
-			return
-		}
-
-		// compression only, get name by removing file extension
-		fname := f.filename
-		split := strings.Split(f.filename, e.sep)
-		base := split[len(split)-1]
-		ext := filepath.Ext(base)
-		if ext == ".xz" {
-			fname = f.filename + e.sep + base[:len(base)-len(ext)]
-		}
-		e.extract(&filestream{r: r, filename: fname})
+	if e.fallback(f, br) {
 		return
 	}
 
-	if mtype == mime.Lz4 {
-		r := lz4.NewReader(br)
+	// not a nested archive, send the input filestream out the channel, with
+	// reader as an io.ReadCloser, wrapped in the extractor's size limits.
+	f.r = wrapCloser(e.limit(br), closer)
+	e.send(f)
+	return
+}
 
-		// compression only, get name by removing file extension
-		fname := f.filename
-		split := strings.Split(f.filename, e.sep)
-		base := split[len(split)-1]
-		ext := filepath.Ext(base)
-		if ext == ".lz4" {
-			fname = f.filename + e.sep + base[:len(base)-len(ext)]
-		}
-		e.extract(&filestream{r: r, filename: fname})
+// send delivers f on e.c, unless the extractor is closed first, in which
+// case it returns false instead of blocking forever on a consumer that has
+// stopped iterating.
+func (e *extractor) send(f *filestream) bool {
+	select {
+	case e.c <- f:
+		return true
+	case <-e.ctx.Done():
+		return false
+	}
+}
+
+// linkCtx cancels e.ctx, same as Close, if ctx is ever cancelled, so send
+// (which only watches e.ctx) unblocks and the background goroutine it
+// gates doesn't leak when a caller cancels ctx and stops calling
+// Next/NextWithError instead of calling Close.
+func (e *extractor) linkCtx(ctx context.Context) {
+	if ctx.Done() == nil {
 		return
 	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			e.cancel()
+		case <-e.ctx.Done():
+		}
+	}()
+}
 
-	// if mtype == mime.Sz {}
+// seekableInput returns a reader suitable for formats needing random access
+// (zip, 7z). If r already supports it (see SizedReaderAt), r is returned
+// unchanged. Otherwise, if SpoolToTemp is enabled, br (which still holds
+// any bytes already consumed from r by the format-detection Peek) is
+// spooled to a temp file and the resulting *os.File is returned; if not, r
+// is returned as-is and the format will report NestError as before.
+func (e *extractor) seekableInput(r io.Reader, br *bufio.Reader) io.Reader {
+	if _, ok := asSizedReaderAt(r); ok {
+		return r
+	}
+	if !e.spoolToTemp {
+		return r
+	}
+	path, err := e.spool(br)
+	if err != nil {
+		return r
+	}
+	// the spool drained br; point it at the spooled copy so its bytes are
+	// still there if the format fails to open and extract falls back.
+	if rf, err := os.Open(path); err == nil {
+		br.Reset(rf)
+	}
+	of, err := os.Open(path)
+	if err != nil {
+		return r
+	}
+	return of
+}
 
-	// not a nested archive, send the input filestream out the channel, with
-	// reader as bufio.Reader
-	f.r = br
-	e.c <- f
-	return
+// activeFormats returns the registered formats minus any excluded by
+// DisableFormats, with gzip/bzip2 swapped for their parallel counterparts
+// when this extractor was built with WithDecoder(DecoderParallel).
+func (e *extractor) activeFormats() []Format {
+	active := make([]Format, 0, len(formats))
+	for _, fm := range formats {
+		if e.disabled[fm.Name()] {
+			continue
+		}
+		if e.decoder == DecoderParallel {
+			switch fm.(type) {
+			case gzipFormat:
+				fm = pgzipFormat{}
+			case bzip2Format:
+				fm = pbzip2Format{}
+			}
+		}
+		active = append(active, fm)
+	}
+	return active
 }
 
 // Next retreives the next reader nested in the reader configured on the
 // extractor instance. If more is false, then the returned reader is nil
 // and should not be used. If more is true, then the reader and filename
-// are valid and ready to be used. The returned reader is only safe to use
-// until Next is called again.
-func (e *extractor) Next() (r *bufio.Reader, filename string, more bool) {
+// are valid and ready to be used; the caller should Close it once done,
+// which releases that entry's resources (e.g. closing a gzip.Reader).
+// ctx can be used by the caller to cancel the extraction early, unblocking
+// and tearing down the background goroutine the same way Close does; it is
+// independent of any Timeout configured on New. Only the ctx passed to the
+// first Next/NextWithError call is linked this way, since that's the one
+// that starts the goroutine.
+func (e *extractor) Next(ctx context.Context) (r io.ReadCloser, filename string, more bool) {
 	e.once.Do(func() {
+		e.linkCtx(ctx)
 		go func() {
 			e.extract(&filestream{r: e.r, filename: e.filename})
 			close(e.c)
@@ -235,14 +438,22 @@ func (e *extractor) Next() (r *bufio.Reader, filename string, more bool) {
 	})
 
 	for {
-		fs, more := <-e.c
-		if !more {
-			return r, filename, more
-		}
-		if fs.err != nil {
-			continue
+		select {
+		case <-ctx.Done():
+			return r, filename, false
+		case fs, ok := <-e.c:
+			if !ok {
+				return r, filename, false
+			}
+			if fs.err != nil {
+				// unlike NextWithError, this entry's reader is never
+				// handed to the caller for cleanup, so close it here
+				// instead of leaking whatever it holds open.
+				fs.r.(io.ReadCloser).Close()
+				continue
+			}
+			return fs.r.(io.ReadCloser), fs.filename, true
 		}
-		return fs.r.(*bufio.Reader), fs.filename, more
 	}
 }
 
@@ -250,19 +461,50 @@ func (e *extractor) Next() (r *bufio.Reader, filename string, more bool) {
 // whether they are valid or not. Generally, if err != nil, the reader should
 // not be used, though its value will not be nil. However, if err == NestError,
 // the reader can be used but it represents a nested archive that cannot be
-// extracted and is most likely useless to the caller.
-func (e *extractor) NextWithError() (r *bufio.Reader, filename string, err error, more bool) {
+// extracted and is most likely useless to the caller. The caller should
+// Close the reader once done with it. ctx can be used by the caller to
+// cancel the extraction early, unblocking and tearing down the background
+// goroutine the same way Close does; it is independent of any Timeout
+// configured on New. Only the ctx passed to the first Next/NextWithError
+// call is linked this way, since that's the one that starts the goroutine.
+func (e *extractor) NextWithError(ctx context.Context) (r io.ReadCloser, filename string, err error, more bool) {
 	e.once.Do(func() {
+		e.linkCtx(ctx)
 		go func() {
 			e.extract(&filestream{r: e.r, filename: e.filename})
 			close(e.c)
 		}()
 	})
 
-	fs, more := <-e.c
-	if !more {
-		// fs==nil if !more
-		return r, filename, err, more
+	select {
+	case <-ctx.Done():
+		return r, filename, ctx.Err(), false
+	case fs, ok := <-e.c:
+		if !ok {
+			return r, filename, err, false
+		}
+		return fs.r.(io.ReadCloser), fs.filename, fs.err, true
+	}
+}
+
+// Close cancels the extraction, unblocking and tearing down the background
+// goroutine spawned by Next/NextWithError if the caller stopped iterating
+// before reaching the end, and removes any temp files created by
+// SpoolToTemp or ExternalTools. It is safe to call more than once; only the
+// first call's error, if any, is returned.
+func (e *extractor) Close() error {
+	e.cancel()
+
+	e.tempMu.Lock()
+	paths := e.tempFiles
+	e.tempFiles = nil
+	e.tempMu.Unlock()
+
+	var err error
+	for _, path := range paths {
+		if rmErr := os.RemoveAll(path); rmErr != nil && err == nil {
+			err = rmErr
+		}
 	}
-	return fs.r.(*bufio.Reader), fs.filename, fs.err, more
+	return err
 }
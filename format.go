@@ -0,0 +1,416 @@
+package extractor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nwaples/rardecode"
+	"github.com/pierrec/lz4"
+	"github.com/ulikunitz/xz"
+
+	"github.com/aerissecure/mime"
+)
+
+// Iterator yields the successive entries of an opened Format. Next returns
+// io.EOF once there are no more entries. Aside from io.EOF, a non-nil error
+// does not abort the whole archive: the entry is reported and iteration
+// continues on the next call.
+type Iterator interface {
+	Next() (name string, r io.Reader, err error)
+}
+
+// Format recognizes and opens one archive or compression format. Built-in
+// formats are registered at package init time; call Register to add more,
+// and DisableFormats to turn individual ones off for a given extractor.
+type Format interface {
+	// Name identifies the format, e.g. "gzip" or "zip". Used by
+	// DisableFormats.
+	Name() string
+	// Detect reports whether peek, a prefix of the stream (up to 512
+	// bytes, fewer near EOF), looks like this format.
+	Detect(peek []byte) bool
+	// Open returns an Iterator over r's entries. ctx is the extractor's
+	// own context (see Timeout); formats whose decoder spawns goroutines
+	// that don't otherwise observe reads stopping (e.g. the parallel
+	// bzip2 decoder) need it to make Close/Timeout actually tear them
+	// down. Formats that don't need it can ignore it.
+	Open(ctx context.Context, r io.Reader) (Iterator, error)
+}
+
+// rawReader is implemented by formats that need random access to the
+// original, unbuffered reader (zip, 7z use io.ReaderAt via SizedReaderAt or
+// *os.File) rather than the sequential, already-peeked reader every other
+// format receives.
+type rawReader interface {
+	needsRawReader()
+}
+
+// extStripper is implemented by compression-only formats whose entries have
+// no filename of their own. When such a format's Iterator returns an empty
+// name, the dispatcher derives one by stripping Ext from the parent
+// filename instead of nesting an empty path segment.
+type extStripper interface {
+	Ext() string
+}
+
+var formats []Format
+
+// Register adds a Format to the set consulted by every extractor
+// subsequently constructed with New. Built-in formats are registered at
+// package init time; call Register from an init function to add your own.
+func Register(f Format) {
+	formats = append(formats, f)
+}
+
+func init() {
+	Register(gzipFormat{})
+	Register(bzip2Format{})
+	Register(zipFormat{})
+	Register(tarFormat{})
+	Register(rarFormat{})
+	Register(xzFormat{})
+	Register(lz4Format{})
+	Register(zstdFormat{})
+	Register(s2Format{})
+	Register(sevenZipFormat{})
+}
+
+// stripExt returns filename with one more nested path segment appended
+// (joined by sep): its final segment with ext removed, so "a.tar:x.bz2"
+// becomes "a.tar:x.bz2:x". If the final segment doesn't end in ext,
+// filename is returned unchanged.
+func stripExt(filename, sep, ext string) string {
+	split := strings.Split(filename, sep)
+	base := split[len(split)-1]
+	if filepath.Ext(base) != ext {
+		return filename
+	}
+	return filename + sep + base[:len(base)-len(ext)]
+}
+
+// isTar reports whether peek looks like the start of a tar archive, i.e.
+// it's long enough to contain the "ustar" magic at its usual header offset.
+func isTar(peek []byte) bool {
+	return len(peek) >= 262 && string(peek[257:262]) == "ustar"
+}
+
+// singleEntry adapts a single-stream decompressor (gzip, bzip2, xz, lz4,
+// zstd, s2) into an Iterator. If the decompressed stream turns out to be a
+// tar archive, its entries are surfaced directly — so "x.tar.gz" extracts
+// as one logical archive instead of two extraction passes with an awkward
+// intermediate filename — otherwise a single entry named name is yielded.
+// If name is empty, the caller names the entry after the parent filename,
+// with the format's extension stripped if it implements extStripper.
+type singleEntry struct {
+	name   string
+	br     *bufio.Reader
+	closer io.Closer
+	tar    *tar.Reader
+	done   bool
+}
+
+func newSingleEntry(r io.Reader, name string, closer io.Closer) Iterator {
+	return &singleEntry{name: name, br: bufio.NewReader(r), closer: closer}
+}
+
+func (s *singleEntry) Next() (string, io.Reader, error) {
+	if s.tar != nil {
+		hdr, err := s.tar.Next()
+		if err != nil {
+			s.close()
+			return "", nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return s.Next()
+		}
+		return hdr.Name, s.tar, nil
+	}
+	if s.done {
+		return "", nil, io.EOF
+	}
+	s.done = true
+
+	peek, _ := s.br.Peek(262)
+	if isTar(peek) {
+		s.tar = tar.NewReader(s.br)
+		return s.Next()
+	}
+	// this is the only entry this decoder will ever yield, so hand the
+	// closer off to it rather than closing in the done branch above: the
+	// caller reads this entry at its own pace, possibly well after the
+	// channel handoff that delivers it, and closing here on the next
+	// Next() call (which the producer goroutine calls immediately to
+	// probe for io.EOF) would race that read and tear the decoder down
+	// out from under it.
+	closer := s.closer
+	s.closer = nil
+	return s.name, singleEntryReader{Reader: s.br, closer: closer}, nil
+}
+
+func (s *singleEntry) close() {
+	if s.closer != nil {
+		s.closer.Close()
+	}
+}
+
+// singleEntryReader carries a singleEntry's real closer alongside its
+// buffered reader so extract can recover it via a type assertion on the
+// entry reader before wrapping that in further bufio.Readers, which would
+// otherwise hide it.
+type singleEntryReader struct {
+	*bufio.Reader
+	closer io.Closer
+}
+
+func (r singleEntryReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+type gzipFormat struct{}
+
+func (gzipFormat) Name() string            { return "gzip" }
+func (gzipFormat) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Gzip }
+func (gzipFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newSingleEntry(gr, gr.Name, gr), nil
+}
+
+type bzip2Format struct{}
+
+func (bzip2Format) Name() string            { return "bzip2" }
+func (bzip2Format) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Bzip2 }
+func (bzip2Format) Ext() string             { return ".bz2" }
+func (bzip2Format) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	return newSingleEntry(bzip2.NewReader(r), "", nil), nil
+}
+
+type xzFormat struct{}
+
+func (xzFormat) Name() string            { return "xz" }
+func (xzFormat) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Xz }
+func (xzFormat) Ext() string             { return ".xz" }
+func (xzFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newSingleEntry(xr, "", nil), nil
+}
+
+type lz4Format struct{}
+
+func (lz4Format) Name() string            { return "lz4" }
+func (lz4Format) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Lz4 }
+func (lz4Format) Ext() string             { return ".lz4" }
+func (lz4Format) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	return newSingleEntry(lz4.NewReader(r), "", nil), nil
+}
+
+var zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+
+type zstdFormat struct{}
+
+func (zstdFormat) Name() string { return "zstd" }
+func (zstdFormat) Detect(peek []byte) bool {
+	return bytes.HasPrefix(peek, zstdMagic)
+}
+func (zstdFormat) Ext() string { return ".zst" }
+func (zstdFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	rc := zr.IOReadCloser()
+	return newSingleEntry(rc, "", rc), nil
+}
+
+// s2Magic is the snappy/s2 framed-stream identifier chunk; s2 reuses the
+// snappy framing format, so both are detected the same way.
+var s2Magic = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+
+type s2Format struct{}
+
+func (s2Format) Name() string { return "s2" }
+func (s2Format) Detect(peek []byte) bool {
+	return bytes.HasPrefix(peek, s2Magic)
+}
+func (s2Format) Ext() string { return ".sz" }
+func (s2Format) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	return newSingleEntry(s2.NewReader(r), "", nil), nil
+}
+
+// SizedReaderAt is implemented by seekable inputs that support random
+// access and know their own length, such as *bytes.Reader,
+// *io.SectionReader, or a range-reader wrapper around remote storage (e.g.
+// S3). Formats that need random access (zip, 7z) use it, falling back to
+// *os.File, as a fast path instead of requiring the reader be spooled to
+// disk first.
+type SizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// asSizedReaderAt adapts r to a SizedReaderAt, wrapping *os.File in an
+// io.SectionReader over its full length if needed.
+func asSizedReaderAt(r io.Reader) (SizedReaderAt, bool) {
+	if sra, ok := r.(SizedReaderAt); ok {
+		return sra, true
+	}
+	if of, ok := r.(*os.File); ok {
+		if fi, err := of.Stat(); err == nil {
+			return io.NewSectionReader(of, 0, fi.Size()), true
+		}
+	}
+	return nil, false
+}
+
+type zipFormat struct{}
+
+func (zipFormat) Name() string            { return "zip" }
+func (zipFormat) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Zip }
+func (zipFormat) needsRawReader()         {}
+
+// Open only succeeds when r supports random access (see SizedReaderAt):
+// zip needs io.ReaderAt, which isn't available on the sequential,
+// already-peeked reader every other format receives. If the caller wants
+// the reader anyway, use NextWithError and check if err == NestError, or
+// configure SpoolToTemp to get ZIP support from a plain io.Reader.
+func (zipFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	sra, ok := asSizedReaderAt(r)
+	if !ok {
+		return nil, NestError
+	}
+	zr, err := zip.NewReader(sra, sra.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &zipIterator{files: zr.File}, nil
+}
+
+type zipIterator struct {
+	files []*zip.File
+	i     int
+}
+
+func (it *zipIterator) Next() (string, io.Reader, error) {
+	if it.i >= len(it.files) {
+		return "", nil, io.EOF
+	}
+	file := it.files[it.i]
+	it.i++
+	zfr, err := file.Open()
+	if err != nil {
+		return file.Name, nil, err
+	}
+	return file.Name, zfr, nil
+}
+
+type tarFormat struct{}
+
+func (tarFormat) Name() string            { return "tar" }
+func (tarFormat) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Tar }
+func (tarFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	return &tarIterator{r: tar.NewReader(r)}, nil
+}
+
+type tarIterator struct {
+	r *tar.Reader
+}
+
+func (it *tarIterator) Next() (string, io.Reader, error) {
+	hdr, err := it.r.Next()
+	if err != nil {
+		return "", nil, err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return it.Next()
+	}
+	return hdr.Name, it.r, nil
+}
+
+type rarFormat struct{}
+
+func (rarFormat) Name() string            { return "rar" }
+func (rarFormat) Detect(peek []byte) bool { return mime.Detect(peek) == mime.Rar }
+func (rarFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	rr, err := rardecode.NewReader(r, "")
+	if err != nil {
+		return nil, err
+	}
+	return &rarIterator{r: rr}, nil
+}
+
+type rarIterator struct {
+	r *rardecode.Reader
+}
+
+func (it *rarIterator) Next() (string, io.Reader, error) {
+	hdr, err := it.r.Next()
+	if err != nil {
+		return "", nil, err
+	}
+	if hdr.IsDir {
+		return it.Next()
+	}
+	return hdr.Name, it.r, nil
+}
+
+var sevenZipMagic = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+
+type sevenZipFormat struct{}
+
+func (sevenZipFormat) Name() string { return "7z" }
+func (sevenZipFormat) Detect(peek []byte) bool {
+	return bytes.HasPrefix(peek, sevenZipMagic)
+}
+func (sevenZipFormat) needsRawReader() {}
+
+// Open only succeeds when r supports random access (see SizedReaderAt),
+// for the same io.ReaderAt reasons as zipFormat.Open.
+func (sevenZipFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	sra, ok := asSizedReaderAt(r)
+	if !ok {
+		return nil, NestError
+	}
+	zr, err := sevenzip.NewReader(sra, sra.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &sevenZipIterator{files: zr.File}, nil
+}
+
+type sevenZipIterator struct {
+	files []*sevenzip.File
+	i     int
+}
+
+func (it *sevenZipIterator) Next() (string, io.Reader, error) {
+	if it.i >= len(it.files) {
+		return "", nil, io.EOF
+	}
+	file := it.files[it.i]
+	it.i++
+	fr, err := file.Open()
+	if err != nil {
+		return file.Name, nil, err
+	}
+	return file.Name, fr, nil
+}
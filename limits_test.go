@@ -0,0 +1,48 @@
+package extractor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// bomb returns a gzip stream of highly compressible data that decompresses
+// to well past the budgets exercised below.
+func bomb() []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(bytes.Repeat([]byte("a"), 10<<20))
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestMaxSizeAbortsBomb(t *testing.T) {
+	e := New(bytes.NewReader(bomb()), "bomb.gz", MaxSize(1<<20))
+	defer e.Close()
+
+	r, _, more := e.Next(context.Background())
+	if !more {
+		t.Fatal("expected an entry")
+	}
+	_, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, ErrMaxSize) {
+		t.Fatalf("got %v, want ErrMaxSize", err)
+	}
+}
+
+func TestMaxTotalSizeAbortsBomb(t *testing.T) {
+	e := New(bytes.NewReader(bomb()), "bomb.gz", MaxTotalSize(1<<20))
+	defer e.Close()
+
+	r, _, more := e.Next(context.Background())
+	if !more {
+		t.Fatal("expected an entry")
+	}
+	_, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, ErrMaxSize) {
+		t.Fatalf("got %v, want ErrMaxSize", err)
+	}
+}
@@ -0,0 +1,74 @@
+package extractor
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/klauspost/pgzip"
+)
+
+// Decoder selects which implementation extracts gzip and bzip2 streams.
+type Decoder int
+
+const (
+	// DecoderStdlib uses compress/gzip and compress/bzip2. It is the
+	// default.
+	DecoderStdlib Decoder = iota
+	// DecoderParallel uses klauspost/pgzip and cosnicolaou/pbzip2, which
+	// decompress across multiple goroutines for a large throughput win on
+	// multi-GB .tar.gz/.tar.bz2 inputs. Worker count is bounded by
+	// SetConcurrency so several concurrent extractors can share one CPU
+	// budget.
+	DecoderParallel
+)
+
+var concurrency = int32(runtime.GOMAXPROCS(0))
+
+// SetConcurrency caps how many goroutines the parallel gzip/bzip2 decoders
+// (see Decoder) may use per decompressed stream, process-wide, so that
+// multiple concurrent extractors share one CPU budget rather than each
+// defaulting to GOMAXPROCS workers of their own. The default is
+// runtime.GOMAXPROCS(0).
+func SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreInt32(&concurrency, int32(n))
+}
+
+func poolSize() int {
+	return int(atomic.LoadInt32(&concurrency))
+}
+
+// pgzipBlockSize is the block size pgzip splits the stream into for its
+// workers; this is the value used by pgzip's own NewWriterLevel default.
+const pgzipBlockSize = 1 << 20
+
+// pgzipFormat is the parallel counterpart to gzipFormat, selected with
+// WithDecoder(DecoderParallel).
+type pgzipFormat struct{}
+
+func (pgzipFormat) Name() string            { return "gzip" }
+func (pgzipFormat) Detect(peek []byte) bool { return gzipFormat{}.Detect(peek) }
+func (pgzipFormat) Open(_ context.Context, r io.Reader) (Iterator, error) {
+	gr, err := pgzip.NewReaderN(r, pgzipBlockSize, poolSize())
+	if err != nil {
+		return nil, err
+	}
+	return newSingleEntry(gr, gr.Name, gr), nil
+}
+
+// pbzip2Format is the parallel counterpart to bzip2Format, selected with
+// WithDecoder(DecoderParallel).
+type pbzip2Format struct{}
+
+func (pbzip2Format) Name() string            { return "bzip2" }
+func (pbzip2Format) Detect(peek []byte) bool { return bzip2Format{}.Detect(peek) }
+func (pbzip2Format) Ext() string             { return ".bz2" }
+func (pbzip2Format) Open(ctx context.Context, r io.Reader) (Iterator, error) {
+	pr := pbzip2.NewReader(ctx, r, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(poolSize())))
+	return newSingleEntry(pr, "", nil), nil
+}